@@ -16,6 +16,7 @@ package external
 
 import (
 	"fmt"
+	"net"
 	"sync"
 	"time"
 
@@ -23,18 +24,69 @@ import (
 	"istio.io/istio/pilot/pkg/model"
 )
 
+// dnsResyncPeriod is how often strict-DNS ServiceEntries (resolution DNS or
+// DNS_ROUND_ROBIN, no static Endpoints) have their Hosts re-resolved so EDS
+// reflects the current A/AAAA records rather than whatever Envoy last cached.
+const dnsResyncPeriod = 30 * time.Second
+
 // TODO: move this out of 'external' package. Either 'serviceentry' package or
 // merge with aggregate (caching, events), and possibly merge both into the
 // config directory, for a single top-level cache and event system.
 
 type serviceHandler func(*model.Service, model.Event)
 type instanceHandler func(*model.ServiceInstance, model.Event)
+type diagnosticHandler func(model.Config, []Diagnostic)
+
+// DiagnosticLevel indicates how serious a Diagnostic is.
+type DiagnosticLevel string
+
+const (
+	// DiagnosticWarning flags a ServiceEntry that will work but likely not as
+	// the operator intends.
+	DiagnosticWarning DiagnosticLevel = "Warning"
+	// DiagnosticError flags a ServiceEntry that is misconfigured badly enough
+	// that it won't behave as declared at all.
+	DiagnosticError DiagnosticLevel = "Error"
+)
+
+// Diagnostic is one configuration problem found by Validate. It's meant to be
+// surfaced as a status condition on the originating ServiceEntry CR, not
+// returned to the caller as an error - registerConfig still indexes whatever
+// it can out of a ServiceEntry that has diagnostics.
+type Diagnostic struct {
+	Level   DiagnosticLevel
+	Message string
+}
+
+// WorkloadInstance is a pod or WorkloadEntry known to match, or potentially
+// match, a ServiceEntry's WorkloadSelector.
+type WorkloadInstance struct {
+	Endpoint model.NetworkEndpoint
+	Labels   model.Labels
+}
+
+// WorkloadInstanceHandler is invoked whenever a workload's labels or
+// lifecycle change in a way that may affect which WorkloadSelectors it
+// matches.
+type WorkloadInstanceHandler func(*WorkloadInstance, model.Event)
+
+// WorkloadInstances is satisfied by whatever keeps track of pods/WorkloadEntries
+// and their labels (e.g. the Kubernetes pod cache). ServiceEntryStore only needs
+// label-keyed change notifications and a way to seed a selector's initial matches.
+type WorkloadInstances interface {
+	// RegisterWorkloadHandler registers a callback invoked on every workload
+	// label/lifecycle change.
+	RegisterWorkloadHandler(handler WorkloadInstanceHandler)
+	// GetByLabels returns the currently known workloads matching selector.
+	GetByLabels(selector map[string]string) []*WorkloadInstance
+}
 
 // ServiceEntryStore communicates with ServiceEntry CRDs and monitors for changes
 type ServiceEntryStore struct {
-	serviceHandlers  []serviceHandler
-	instanceHandlers []instanceHandler
-	store            model.IstioConfigStore
+	serviceHandlers    []serviceHandler
+	instanceHandlers   []instanceHandler
+	diagnosticHandlers []diagnosticHandler
+	store              model.IstioConfigStore
 
 	// storeCache has callbacks. Some tests use mock store.
 	// Pilot 0.8 implementation only invalidates the v1 cache.
@@ -42,56 +94,838 @@ type ServiceEntryStore struct {
 	// simplify and optimize the code, this abstraction is not helping.
 	callbacks model.ConfigStoreCache
 
+	// workloads resolves WorkloadSelector-based ServiceEntries to the pods/
+	// WorkloadEntries they currently match. Nil if no such dependency is wired
+	// up, in which case WorkloadSelector ServiceEntries simply have no instances.
+	workloads WorkloadInstances
+
 	storeMutex sync.RWMutex
 
 	ip2instance map[string][]*model.ServiceInstance
 	// Endpoints table. Key is the fqdn of the service, ':', port
 	instances map[string][]*model.ServiceInstance
 
+	// instancesByKey and servicesByKey remember what a given ServiceEntry
+	// config (keyed by config.Key()) last contributed to the indexes above,
+	// so an Add/Update/Delete event can remove exactly what it previously
+	// added instead of rebuilding instances/ip2instance from scratch.
+	instancesByKey map[string][]*model.ServiceInstance
+	servicesByKey  map[string][]*model.Service
+
+	// selectorsByKey holds the WorkloadSelector of each WorkloadSelector-based
+	// ServiceEntry, keyed by config.Key().
+	selectorsByKey map[string]map[string]string
+	// specsByKey caches the latest spec of every currently-registered
+	// ServiceEntry, keyed by config.Key(). It backs both the WorkloadSelector
+	// re-evaluation path and the namespace-scoped Services() lookups below.
+	specsByKey map[string]*networking.ServiceEntry
+	// selectorIndex is the reverse index: "label=value" -> configKeys of the
+	// ServiceEntries whose WorkloadSelector references that label, so a workload
+	// label change only needs to re-evaluate the selectors it could plausibly affect.
+	selectorIndex map[string][]string
+	// workloadInstancesByKey is configKey -> workload address -> the instances
+	// synthesized for that workload, so a single workload's match can be updated
+	// without touching the rest of the selector's matches.
+	workloadInstancesByKey map[string]map[string][]*model.ServiceInstance
+
+	// namespaceByKey and configsByNamespace are the reverse of each other:
+	// configKey -> source namespace, and namespace -> []configKey. The latter
+	// lets Services(namespace) enumerate the ServiceEntries sourced from that
+	// namespace instead of scanning every known config.
+	namespaceByKey     map[string]string
+	configsByNamespace map[string][]string
+
+	// exportToByKey and exportIndex are the exportTo analog of namespaceByKey/
+	// configsByNamespace: configKey -> the Visibility set last indexed for it
+	// (ServiceEntries with no ExportTo are indexed as VisibilityPublic, the
+	// default), and Visibility value -> []configKey. exportIndex lets
+	// configKeysForNamespace also find ServiceEntries sourced from *other*
+	// namespaces that export to "*" or name the requested namespace, without
+	// scanning every registered config.
+	exportToByKey map[string]map[model.Visibility]bool
+	exportIndex   map[string][]string
+
+	// autoMTLSRequiresL7 mirrors the mesh-wide setting requiring an L7
+	// protocol for auto mTLS to apply; Validate warns when a ServiceEntry
+	// declares a TCP/TLS port under this setting, since auto mTLS can't be
+	// enforced for it.
+	autoMTLSRequiresL7 bool
+
 	lastChange   time.Time
 	updateNeeded bool
 }
 
-// NewServiceDiscovery creates a new ServiceEntry discovery service
-func NewServiceDiscovery(callbacks model.ConfigStoreCache, store model.IstioConfigStore) *ServiceEntryStore {
+// NewServiceDiscovery creates a new ServiceEntry discovery service.
+// autoMTLSRequiresL7 mirrors the mesh-wide auto mTLS setting, so Validate can
+// flag ServiceEntries whose TCP/TLS ports can't have auto mTLS enforced.
+func NewServiceDiscovery(callbacks model.ConfigStoreCache, store model.IstioConfigStore, workloads WorkloadInstances,
+	autoMTLSRequiresL7 bool) *ServiceEntryStore {
 	c := &ServiceEntryStore{
-		serviceHandlers:  make([]serviceHandler, 0),
-		instanceHandlers: make([]instanceHandler, 0),
-		store:            store,
-		callbacks:        callbacks,
-		ip2instance:      map[string][]*model.ServiceInstance{},
-		instances:        map[string][]*model.ServiceInstance{},
-		updateNeeded:     true,
+		serviceHandlers:        make([]serviceHandler, 0),
+		instanceHandlers:       make([]instanceHandler, 0),
+		diagnosticHandlers:     make([]diagnosticHandler, 0),
+		store:                  store,
+		callbacks:              callbacks,
+		workloads:              workloads,
+		ip2instance:            map[string][]*model.ServiceInstance{},
+		instances:              map[string][]*model.ServiceInstance{},
+		instancesByKey:         map[string][]*model.ServiceInstance{},
+		servicesByKey:          map[string][]*model.Service{},
+		selectorsByKey:         map[string]map[string]string{},
+		specsByKey:             map[string]*networking.ServiceEntry{},
+		selectorIndex:          map[string][]string{},
+		workloadInstancesByKey: map[string]map[string][]*model.ServiceInstance{},
+		namespaceByKey:         map[string]string{},
+		configsByNamespace:     map[string][]string{},
+		exportToByKey:          map[string]map[model.Visibility]bool{},
+		exportIndex:            map[string][]string{},
+		autoMTLSRequiresL7:     autoMTLSRequiresL7,
+		updateNeeded:           true,
 	}
 	if callbacks != nil {
 		callbacks.RegisterEventHandler(model.ServiceEntry.Type, func(config model.Config, event model.Event) {
 			serviceEntry := config.Spec.(*networking.ServiceEntry)
+			key := config.Key()
 
-			// Recomputing the index here is too expensive.
+			// Apply the diff directly to instances/ip2instance rather than
+			// marking the whole index stale: remove what this config key
+			// contributed last time (static or selector-derived), then add
+			// back what it contributes now.
 			c.storeMutex.Lock()
+			oldServices := c.servicesByKey[key]
+			// instancesByKey[key] is accurate for static/DNS-synthesized
+			// instances, but a WorkloadSelector key's matched workloads can
+			// have changed since registerConfig last set instancesByKey via
+			// updateWorkloadInstance, which updates workloadInstancesByKey
+			// incrementally without ever touching instancesByKey. For a
+			// selector key, clearSelector's returned set is the authoritative
+			// one; using instancesByKey there as well would both double-count
+			// it and miss any selector-driven changes since the last event.
+			var oldInstances []*model.ServiceInstance
+			if _, isSelector := c.selectorsByKey[key]; isSelector {
+				oldInstances = c.clearSelector(key)
+			} else {
+				oldInstances = c.instancesByKey[key]
+				c.clearSelector(key)
+			}
+			c.removeInstances(oldInstances)
+			c.deindexNamespace(key)
+			c.deindexExportTo(key)
+
+			var newServices []*model.Service
+			var newInstances []*model.ServiceInstance
+			if event == model.EventDelete {
+				delete(c.instancesByKey, key)
+				delete(c.servicesByKey, key)
+				delete(c.specsByKey, key)
+			} else {
+				newServices, newInstances = c.registerConfig(key, config, serviceEntry)
+				c.addInstances(newInstances)
+				c.instancesByKey[key] = newInstances
+				c.servicesByKey[key] = newServices
+			}
 			c.lastChange = time.Now()
-			c.updateNeeded = true
 			c.storeMutex.Unlock()
 
-			services := convertServices(serviceEntry)
 			for _, handler := range c.serviceHandlers {
-				for _, service := range services {
+				for _, service := range changedServices(oldServices, newServices, event) {
 					go handler(service, event)
 				}
+				for _, service := range removedServices(oldServices, newServices, event) {
+					go handler(service, model.EventDelete)
+				}
 			}
 
-			instances := convertInstances(serviceEntry)
 			for _, handler := range c.instanceHandlers {
-				for _, instance := range instances {
+				for _, instance := range changedInstances(oldInstances, newInstances, event) {
 					go handler(instance, event)
 				}
+				for _, instance := range removedInstances(oldInstances, newInstances, event) {
+					go handler(instance, model.EventDelete)
+				}
+			}
+
+			if event != model.EventDelete {
+				diagnostics := c.Validate(config)
+				for _, handler := range c.diagnosticHandlers {
+					go handler(config, diagnostics)
+				}
 			}
 		})
 	}
+	if workloads != nil {
+		workloads.RegisterWorkloadHandler(c.updateWorkloadInstance)
+	}
 
 	return c
 }
 
+// registerConfig builds and namespace/exportTo-tags the services/instances for
+// a ServiceEntry being added or updated, and records the spec and namespace
+// bookkeeping that later incremental lookups and updates rely on. Callers
+// must hold storeMutex for writing.
+func (d *ServiceEntryStore) registerConfig(key string, config model.Config, serviceEntry *networking.ServiceEntry) ([]*model.Service, []*model.ServiceInstance) {
+	d.specsByKey[key] = serviceEntry
+	d.indexNamespace(key, config.Namespace)
+
+	exportTo := convertExportTo(serviceEntry.ExportTo)
+	d.indexExportTo(key, exportTo)
+	services := convertServices(serviceEntry)
+	instances := d.buildInstances(key, serviceEntry)
+	tagServices(services, config.Namespace, exportTo)
+	tagInstances(instances, config.Namespace, exportTo)
+	return services, instances
+}
+
+// buildInstances converts a ServiceEntry into its current ServiceInstances. A
+// ServiceEntry with a WorkloadSelector and no static Endpoints has its
+// instances synthesized from whatever workloads currently match the selector;
+// the selector is also registered in selectorIndex so future workload label
+// changes are picked up incrementally. A DNS-resolution ServiceEntry with no
+// static Endpoints gets hostname-keyed instances from convertDNSInstances
+// instead, even if it also has a WorkloadSelector. Callers must hold
+// storeMutex for writing.
+func (d *ServiceEntryStore) buildInstances(key string, serviceEntry *networking.ServiceEntry) []*model.ServiceInstance {
+	if len(serviceEntry.Endpoints) == 0 && isDNSResolution(serviceEntry.Resolution) {
+		return convertDNSInstances(serviceEntry)
+	}
+	if serviceEntry.WorkloadSelector == nil || len(serviceEntry.Endpoints) > 0 {
+		return convertInstances(serviceEntry)
+	}
+
+	selector := serviceEntry.WorkloadSelector.Labels
+	d.selectorsByKey[key] = selector
+	d.indexSelector(key, selector)
+
+	if d.workloads == nil {
+		return nil
+	}
+
+	matched := map[string][]*model.ServiceInstance{}
+	var instances []*model.ServiceInstance
+	for _, workload := range d.workloads.GetByLabels(selector) {
+		wi := convertWorkloadInstances(serviceEntry, workload)
+		matched[workload.Endpoint.Address] = wi
+		instances = append(instances, wi...)
+	}
+	d.workloadInstancesByKey[key] = matched
+	return instances
+}
+
+// clearSelector removes any WorkloadSelector bookkeeping previously registered
+// for key and returns the instances it had synthesized. Callers must hold
+// storeMutex for writing.
+func (d *ServiceEntryStore) clearSelector(key string) []*model.ServiceInstance {
+	old := flattenWorkloadInstances(d.workloadInstancesByKey[key])
+	d.deindexSelector(key, d.selectorsByKey[key])
+	delete(d.selectorsByKey, key)
+	delete(d.workloadInstancesByKey, key)
+	return old
+}
+
+// indexNamespace registers key's source namespace in namespaceByKey/
+// configsByNamespace. Callers must hold storeMutex for writing.
+func (d *ServiceEntryStore) indexNamespace(key, namespace string) {
+	d.namespaceByKey[key] = namespace
+	d.configsByNamespace[namespace] = append(d.configsByNamespace[namespace], key)
+}
+
+// deindexNamespace undoes indexNamespace. Callers must hold storeMutex for writing.
+func (d *ServiceEntryStore) deindexNamespace(key string) {
+	namespace, found := d.namespaceByKey[key]
+	if !found {
+		return
+	}
+	delete(d.namespaceByKey, key)
+	d.configsByNamespace[namespace] = removeKey(d.configsByNamespace[namespace], key)
+	if len(d.configsByNamespace[namespace]) == 0 {
+		delete(d.configsByNamespace, namespace)
+	}
+}
+
+// indexExportTo registers key under exportIndex for each Visibility value in
+// exportTo, treating no ExportTo at all as VisibilityPublic to match
+// visibleToNamespace's "no restriction" default. Callers must hold storeMutex
+// for writing.
+func (d *ServiceEntryStore) indexExportTo(key string, exportTo map[model.Visibility]bool) {
+	if len(exportTo) == 0 {
+		exportTo = map[model.Visibility]bool{model.VisibilityPublic: true}
+	}
+	d.exportToByKey[key] = exportTo
+	for vis := range exportTo {
+		d.exportIndex[string(vis)] = append(d.exportIndex[string(vis)], key)
+	}
+}
+
+// deindexExportTo undoes indexExportTo. Callers must hold storeMutex for writing.
+func (d *ServiceEntryStore) deindexExportTo(key string) {
+	exportTo, found := d.exportToByKey[key]
+	if !found {
+		return
+	}
+	delete(d.exportToByKey, key)
+	for vis := range exportTo {
+		kv := string(vis)
+		d.exportIndex[kv] = removeKey(d.exportIndex[kv], key)
+		if len(d.exportIndex[kv]) == 0 {
+			delete(d.exportIndex, kv)
+		}
+	}
+}
+
+// convertExportTo turns a ServiceEntry's raw ExportTo strings into the
+// model.Visibility set model.ServiceAttributes expects. No ExportTo at all
+// means "no restriction", matching the ServiceEntry API's default.
+func convertExportTo(exportTo []string) map[model.Visibility]bool {
+	if len(exportTo) == 0 {
+		return nil
+	}
+	out := make(map[model.Visibility]bool, len(exportTo))
+	for _, e := range exportTo {
+		out[model.Visibility(e)] = true
+	}
+	return out
+}
+
+// tagServices stamps every service with the namespace/exportTo of the
+// ServiceEntry it came from, so later lookups can enforce visibility.
+func tagServices(services []*model.Service, namespace string, exportTo map[model.Visibility]bool) {
+	for _, service := range services {
+		service.Attributes = model.ServiceAttributes{
+			Name:      service.Hostname.String(),
+			Namespace: namespace,
+			ExportTo:  exportTo,
+		}
+	}
+}
+
+// tagInstances is tagServices' instance-level analog: it stamps the Service
+// embedded in each instance, since convertInstances/convertWorkloadInstances
+// build their own Service values rather than sharing the ones from
+// convertServices.
+func tagInstances(instances []*model.ServiceInstance, namespace string, exportTo map[model.Visibility]bool) {
+	for _, instance := range instances {
+		if instance.Service == nil {
+			continue
+		}
+		instance.Service.Attributes = model.ServiceAttributes{
+			Name:      instance.Service.Hostname.String(),
+			Namespace: namespace,
+			ExportTo:  exportTo,
+		}
+	}
+}
+
+// visibleToNamespace reports whether something tagged with sourceNamespace and
+// exportTo is visible to a proxy in namespace ns. No ExportTo defaults to
+// visible everywhere, matching the ServiceEntry API's default.
+func visibleToNamespace(sourceNamespace string, exportTo map[model.Visibility]bool, ns string) bool {
+	if len(exportTo) == 0 || exportTo[model.VisibilityPublic] {
+		return true
+	}
+	if exportTo[model.VisibilityPrivate] && sourceNamespace == ns {
+		return true
+	}
+	return exportTo[model.Visibility(ns)]
+}
+
+// instanceVisible reports whether instance is visible to namespace ns. An
+// empty ns disables filtering, for callers that aren't evaluating visibility
+// on behalf of a specific proxy.
+func instanceVisible(instance *model.ServiceInstance, ns string) bool {
+	if ns == "" || instance.Service == nil {
+		return true
+	}
+	return visibleToNamespace(instance.Service.Attributes.Namespace, instance.Service.Attributes.ExportTo, ns)
+}
+
+// updateWorkloadInstance re-evaluates every WorkloadSelector that could
+// plausibly be affected by workload's labels, updating the synthesized
+// instances for the ones whose match against workload actually changed.
+func (d *ServiceEntryStore) updateWorkloadInstance(workload *WorkloadInstance, event model.Event) {
+	d.storeMutex.Lock()
+	candidates := map[string]bool{}
+	for k, v := range workload.Labels {
+		for _, key := range d.selectorIndex[labelKV(k, v)] {
+			candidates[key] = true
+		}
+	}
+	if event == model.EventDelete || event == model.EventUpdate {
+		// workload.Labels is the workload's *current* labels; a delete has no
+		// current labels to speak of, and an update may have changed them
+		// enough to no longer hit the selector(s) it used to match (e.g.
+		// relabeled out of a selector entirely). Either way the labels alone
+		// can't tell us what to clean up, so fall back to checking every
+		// selector for a stale entry.
+		for key := range d.selectorsByKey {
+			candidates[key] = true
+		}
+	}
+
+	type change struct {
+		old, new []*model.ServiceInstance
+	}
+	changes := make([]change, 0, len(candidates))
+	for key := range candidates {
+		selector := d.selectorsByKey[key]
+		serviceEntry := d.specsByKey[key]
+		if selector == nil || serviceEntry == nil {
+			continue
+		}
+
+		byAddr := d.workloadInstancesByKey[key]
+		old := byAddr[workload.Endpoint.Address]
+
+		var updated []*model.ServiceInstance
+		if event != model.EventDelete && selectorMatches(selector, workload.Labels) {
+			updated = convertWorkloadInstances(serviceEntry, workload)
+			tagInstances(updated, d.namespaceByKey[key], convertExportTo(serviceEntry.ExportTo))
+		}
+		if len(old) == 0 && len(updated) == 0 {
+			continue
+		}
+
+		d.removeInstances(old)
+		d.addInstances(updated)
+		if byAddr == nil {
+			byAddr = map[string][]*model.ServiceInstance{}
+			d.workloadInstancesByKey[key] = byAddr
+		}
+		if len(updated) == 0 {
+			delete(byAddr, workload.Endpoint.Address)
+		} else {
+			byAddr[workload.Endpoint.Address] = updated
+		}
+		changes = append(changes, change{old: old, new: updated})
+	}
+	d.lastChange = time.Now()
+	d.storeMutex.Unlock()
+
+	for _, c := range changes {
+		instEvent := model.EventUpdate
+		switch {
+		case len(c.old) == 0:
+			instEvent = model.EventAdd
+		case len(c.new) == 0:
+			instEvent = model.EventDelete
+		}
+		for _, handler := range d.instanceHandlers {
+			for _, instance := range changedInstances(c.old, c.new, instEvent) {
+				go handler(instance, instEvent)
+			}
+			for _, instance := range removedInstances(c.old, c.new, instEvent) {
+				go handler(instance, model.EventDelete)
+			}
+		}
+	}
+}
+
+// convertWorkloadInstances synthesizes the ServiceInstances a matching
+// workload contributes to a WorkloadSelector ServiceEntry: one per declared
+// host/port, using the workload's address as the endpoint and its labels in
+// place of static Endpoints.Labels.
+func convertWorkloadInstances(serviceEntry *networking.ServiceEntry, workload *WorkloadInstance) []*model.ServiceInstance {
+	services := convertServices(serviceEntry)
+	out := make([]*model.ServiceInstance, 0, len(services)*len(serviceEntry.Ports))
+	for _, service := range services {
+		for _, port := range serviceEntry.Ports {
+			out = append(out, &model.ServiceInstance{
+				Service: service,
+				Labels:  workload.Labels,
+				Endpoint: model.NetworkEndpoint{
+					Address: workload.Endpoint.Address,
+					Port:    int(port.Number),
+					ServicePort: &model.Port{
+						Name:     port.Name,
+						Port:     int(port.Number),
+						Protocol: model.ParseProtocol(port.Protocol),
+					},
+				},
+			})
+		}
+	}
+	return out
+}
+
+func flattenWorkloadInstances(byAddr map[string][]*model.ServiceInstance) []*model.ServiceInstance {
+	var out []*model.ServiceInstance
+	for _, instances := range byAddr {
+		out = append(out, instances...)
+	}
+	return out
+}
+
+func labelKV(k, v string) string {
+	return k + "=" + v
+}
+
+// indexSelector registers key under selectorIndex for each label in selector.
+// Callers must hold storeMutex for writing.
+func (d *ServiceEntryStore) indexSelector(key string, selector map[string]string) {
+	for k, v := range selector {
+		kv := labelKV(k, v)
+		d.selectorIndex[kv] = append(d.selectorIndex[kv], key)
+	}
+}
+
+// deindexSelector undoes indexSelector. Callers must hold storeMutex for writing.
+func (d *ServiceEntryStore) deindexSelector(key string, selector map[string]string) {
+	for k, v := range selector {
+		kv := labelKV(k, v)
+		d.selectorIndex[kv] = removeKey(d.selectorIndex[kv], key)
+		if len(d.selectorIndex[kv]) == 0 {
+			delete(d.selectorIndex, kv)
+		}
+	}
+}
+
+func removeKey(list []string, key string) []string {
+	out := make([]string, 0, len(list))
+	for _, k := range list {
+		if k != key {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// selectorMatches returns true if labels contains every key/value pair in selector.
+func selectorMatches(selector map[string]string, labels model.Labels) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// removeInstances deletes instances from the instances/ip2instance indexes.
+// Callers must hold storeMutex for writing.
+func (d *ServiceEntryStore) removeInstances(instances []*model.ServiceInstance) {
+	for _, instance := range instances {
+		host := instance.Service.Hostname.String()
+		d.instances[host] = removeInstance(d.instances[host], instance)
+		if len(d.instances[host]) == 0 {
+			delete(d.instances, host)
+		}
+
+		addr := instance.Endpoint.Address
+		if net.ParseIP(addr) == nil {
+			// Hostname-keyed endpoint (DNS resolution with no static
+			// Endpoints) - never indexed by IP in the first place.
+			continue
+		}
+		d.ip2instance[addr] = removeInstance(d.ip2instance[addr], instance)
+		if len(d.ip2instance[addr]) == 0 {
+			delete(d.ip2instance, addr)
+		}
+	}
+}
+
+// addInstances adds instances to the instances/ip2instance indexes.
+// Callers must hold storeMutex for writing.
+func (d *ServiceEntryStore) addInstances(instances []*model.ServiceInstance) {
+	for _, instance := range instances {
+		host := instance.Service.Hostname.String()
+		d.instances[host] = append(d.instances[host], instance)
+
+		addr := instance.Endpoint.Address
+		if net.ParseIP(addr) == nil {
+			// Hostname-keyed endpoint (DNS resolution with no static
+			// Endpoints): Envoy does the DNS lookup itself, so there's no
+			// proxy IP to index this under.
+			continue
+		}
+		d.ip2instance[addr] = append(d.ip2instance[addr], instance)
+	}
+}
+
+// isDNSResolution returns true for the ServiceEntry resolution modes where
+// Envoy (or, once re-resolved, pilot) is expected to resolve Hosts via DNS
+// rather than dispatch to statically declared Endpoints.
+func isDNSResolution(resolution networking.ServiceEntry_Resolution) bool {
+	return resolution == networking.ServiceEntry_DNS || resolution == networking.ServiceEntry_DNS_ROUND_ROBIN
+}
+
+// convertDNSInstances synthesizes one ServiceInstance per declared host/port
+// for a DNS-resolution ServiceEntry with no explicit Endpoints, using the
+// hostname itself as the endpoint address so Envoy performs the DNS lookup at
+// request time. Each service's own Hostname is used rather than pairing it
+// with serviceEntry.Hosts by position, so the two can't drift if
+// convertServices ever dedups or reorders hosts.
+func convertDNSInstances(serviceEntry *networking.ServiceEntry) []*model.ServiceInstance {
+	services := convertServices(serviceEntry)
+	out := make([]*model.ServiceInstance, 0, len(services)*len(serviceEntry.Ports))
+	for _, service := range services {
+		out = append(out, dnsInstancesForHost(service, serviceEntry, service.Hostname.String())...)
+	}
+	return out
+}
+
+// dnsInstancesForHost builds one ServiceInstance per declared port of
+// serviceEntry for service, all pointed at address - either the bare hostname
+// (before the first re-resolution) or a resolved IP.
+func dnsInstancesForHost(service *model.Service, serviceEntry *networking.ServiceEntry, address string) []*model.ServiceInstance {
+	out := make([]*model.ServiceInstance, 0, len(serviceEntry.Ports))
+	for _, port := range serviceEntry.Ports {
+		out = append(out, &model.ServiceInstance{
+			Service: service,
+			Endpoint: model.NetworkEndpoint{
+				Address: address,
+				Port:    int(port.Number),
+				ServicePort: &model.Port{
+					Name:     port.Name,
+					Port:     int(port.Number),
+					Protocol: model.ParseProtocol(port.Protocol),
+				},
+			},
+		})
+	}
+	return out
+}
+
+// resolveInstances looks up the current A/AAAA records for each of
+// serviceEntry's Hosts (via each converted service's own Hostname, rather
+// than serviceEntry.Hosts by position), synthesizing one instance per
+// resolved IP and port. A host that fails to resolve keeps its hostname-keyed
+// instance so Envoy can still fall back to resolving it itself.
+func resolveInstances(serviceEntry *networking.ServiceEntry) []*model.ServiceInstance {
+	services := convertServices(serviceEntry)
+	out := make([]*model.ServiceInstance, 0, len(services)*len(serviceEntry.Ports))
+	for _, service := range services {
+		host := service.Hostname.String()
+		addrs, err := net.LookupHost(host)
+		if err != nil || len(addrs) == 0 {
+			out = append(out, dnsInstancesForHost(service, serviceEntry, host)...)
+			continue
+		}
+		for _, addr := range addrs {
+			out = append(out, dnsInstancesForHost(service, serviceEntry, addr)...)
+		}
+	}
+	return out
+}
+
+// Validate flags common ServiceEntry misconfigurations before they reach the
+// index: STATIC resolution with no Endpoints and no WorkloadSelector either
+// (a WorkloadSelector ServiceEntry is legitimately STATIC with no static
+// Endpoints - its instances come from matching workloads instead), TCP/TLS
+// ports with no Addresses when another registered ServiceEntry shares a Host
+// (Envoy then routes by port alone and the two entries can collide), and
+// TCP/TLS ports declared while the mesh requires an L7 protocol for auto
+// mTLS. Callers must not hold storeMutex, since it locks for reading itself.
+func (d *ServiceEntryStore) Validate(config model.Config) []Diagnostic {
+	serviceEntry, ok := config.Spec.(*networking.ServiceEntry)
+	if !ok {
+		return nil
+	}
+
+	var diagnostics []Diagnostic
+	if serviceEntry.Resolution == networking.ServiceEntry_STATIC && len(serviceEntry.Endpoints) == 0 &&
+		serviceEntry.WorkloadSelector == nil {
+		diagnostics = append(diagnostics, Diagnostic{
+			Level:   DiagnosticError,
+			Message: "resolution is STATIC but no endpoints are declared",
+		})
+	}
+
+	if len(serviceEntry.Addresses) == 0 && d.hasOverlappingTCPHosts(config.Key(), serviceEntry) {
+		diagnostics = append(diagnostics, Diagnostic{
+			Level:   DiagnosticWarning,
+			Message: "TCP/TLS ports with no addresses route by port only and collide with another ServiceEntry sharing a host",
+		})
+	}
+
+	if d.autoMTLSRequiresL7 && hasTCPPort(serviceEntry) {
+		diagnostics = append(diagnostics, Diagnostic{
+			Level:   DiagnosticWarning,
+			Message: "the mesh requires an L7 protocol for auto mTLS, but this ServiceEntry declares a TCP/TLS port",
+		})
+	}
+
+	return diagnostics
+}
+
+// hasOverlappingTCPHosts reports whether another currently-registered
+// ServiceEntry with a TCP/TLS port and no Addresses shares one of
+// serviceEntry's Hosts - the scenario where Envoy, lacking per-entry
+// addresses, routes purely by port and could dispatch to the wrong entry.
+func (d *ServiceEntryStore) hasOverlappingTCPHosts(key string, serviceEntry *networking.ServiceEntry) bool {
+	if !hasTCPPort(serviceEntry) {
+		return false
+	}
+	hosts := make(map[string]bool, len(serviceEntry.Hosts))
+	for _, host := range serviceEntry.Hosts {
+		hosts[host] = true
+	}
+
+	d.storeMutex.RLock()
+	defer d.storeMutex.RUnlock()
+	for otherKey, other := range d.specsByKey {
+		if otherKey == key || len(other.Addresses) > 0 || !hasTCPPort(other) {
+			continue
+		}
+		for _, host := range other.Hosts {
+			if hosts[host] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasTCPPort returns true if serviceEntry declares at least one TCP or TLS port.
+func hasTCPPort(serviceEntry *networking.ServiceEntry) bool {
+	for _, port := range serviceEntry.Ports {
+		switch port.Protocol {
+		case "TCP", "TLS":
+			return true
+		}
+	}
+	return false
+}
+
+func removeInstance(list []*model.ServiceInstance, instance *model.ServiceInstance) []*model.ServiceInstance {
+	out := make([]*model.ServiceInstance, 0, len(list))
+	for _, existing := range list {
+		if existing != instance {
+			out = append(out, existing)
+		}
+	}
+	return out
+}
+
+// changedInstances returns the subset of newInstances whose converted output
+// actually differs from oldInstances (by hostname, endpoint address, port and
+// labels). This keeps no-op ServiceEntry updates from fanning out into ADS
+// pushes. Callers must pair this with removedInstances and announce that
+// subset with model.EventDelete rather than event, since an update can drop
+// an old instance without the removal being a "change" to any new one.
+func changedInstances(oldInstances, newInstances []*model.ServiceInstance, event model.Event) []*model.ServiceInstance {
+	if event == model.EventDelete {
+		return nil
+	}
+	if event == model.EventAdd || len(oldInstances) == 0 {
+		return newInstances
+	}
+
+	out := make([]*model.ServiceInstance, 0, len(newInstances))
+	for _, instance := range newInstances {
+		if match := findMatchingInstance(instance, oldInstances); match == nil || !instancesEqual(instance, match) {
+			out = append(out, instance)
+		}
+	}
+	return out
+}
+
+// removedInstances returns the oldInstances that are gone from newInstances:
+// the whole old set on EventDelete, or whatever an update dropped without
+// replacing. Callers must announce these to instanceHandlers with
+// model.EventDelete regardless of the triggering event, so a removed
+// endpoint isn't mistaken for a live one that merely changed.
+func removedInstances(oldInstances, newInstances []*model.ServiceInstance, event model.Event) []*model.ServiceInstance {
+	if event == model.EventDelete {
+		return oldInstances
+	}
+	if event == model.EventAdd || len(oldInstances) == 0 {
+		return nil
+	}
+
+	out := make([]*model.ServiceInstance, 0, len(oldInstances))
+	for _, instance := range oldInstances {
+		if findMatchingInstance(instance, newInstances) == nil {
+			out = append(out, instance)
+		}
+	}
+	return out
+}
+
+// changedServices is the service-level analog of changedInstances.
+func changedServices(oldServices, newServices []*model.Service, event model.Event) []*model.Service {
+	if event == model.EventDelete {
+		return nil
+	}
+	if event == model.EventAdd || len(oldServices) == 0 {
+		return newServices
+	}
+
+	out := make([]*model.Service, 0, len(newServices))
+	for _, service := range newServices {
+		if match := findMatchingService(service, oldServices); match == nil || !servicesEqual(service, match) {
+			out = append(out, service)
+		}
+	}
+	return out
+}
+
+// removedServices is the service-level analog of removedInstances.
+func removedServices(oldServices, newServices []*model.Service, event model.Event) []*model.Service {
+	if event == model.EventDelete {
+		return oldServices
+	}
+	if event == model.EventAdd || len(oldServices) == 0 {
+		return nil
+	}
+
+	out := make([]*model.Service, 0, len(oldServices))
+	for _, service := range oldServices {
+		if findMatchingService(service, newServices) == nil {
+			out = append(out, service)
+		}
+	}
+	return out
+}
+
+func findMatchingInstance(instance *model.ServiceInstance, list []*model.ServiceInstance) *model.ServiceInstance {
+	for _, other := range list {
+		if other.Service.Hostname == instance.Service.Hostname &&
+			other.Endpoint.Address == instance.Endpoint.Address &&
+			other.Endpoint.ServicePort.Port == instance.Endpoint.ServicePort.Port {
+			return other
+		}
+	}
+	return nil
+}
+
+func instancesEqual(a, b *model.ServiceInstance) bool {
+	return a.Endpoint.Address == b.Endpoint.Address &&
+		a.Endpoint.ServicePort.Port == b.Endpoint.ServicePort.Port &&
+		labelsEqual(a.Labels, b.Labels)
+}
+
+func findMatchingService(service *model.Service, list []*model.Service) *model.Service {
+	for _, other := range list {
+		if other.Hostname == service.Hostname {
+			return other
+		}
+	}
+	return nil
+}
+
+func servicesEqual(a, b *model.Service) bool {
+	if len(a.Ports) != len(b.Ports) {
+		return false
+	}
+	for i, port := range a.Ports {
+		if *port != *b.Ports[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func labelsEqual(a, b model.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
 // AppendServiceHandler is an over-complicated way to add the v1 cache invalidation.
 // In <0.8 pilot it is not usingthe event or service param.
 // Deprecated: post 0.8 we're planning to use direct interface
@@ -108,23 +942,132 @@ func (d *ServiceEntryStore) AppendInstanceHandler(f func(*model.ServiceInstance,
 	return nil
 }
 
-// Run is used by some controllers to execute background jobs after init is done.
-func (d *ServiceEntryStore) Run(stop <-chan struct{}) {}
+// AppendDiagnosticHandler registers f to be called with whatever Diagnostics
+// Validate found for a ServiceEntry on every Add/Update, so operators can wire
+// them to status conditions on the CR.
+func (d *ServiceEntryStore) AppendDiagnosticHandler(f func(model.Config, []Diagnostic)) {
+	d.diagnosticHandlers = append(d.diagnosticHandlers, f)
+}
 
-// Services list declarations of all services in the system
-func (d *ServiceEntryStore) Services() ([]*model.Service, error) {
-	services := make([]*model.Service, 0)
+// Run periodically re-resolves strict-DNS ServiceEntries (resolution DNS or
+// DNS_ROUND_ROBIN, no static Endpoints) and republishes EDS with whatever IPs
+// they currently resolve to, so operators can point a ServiceEntry at a CNAME
+// or an external LB's DNS name and have pilot track it as it changes.
+func (d *ServiceEntryStore) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(dnsResyncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.resolveDNSEntries()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// resolveDNSEntries re-resolves every strict-DNS ServiceEntry's Hosts and
+// swaps in the newly-resolved instances, notifying instanceHandlers of
+// whatever actually changed since the last pass.
+func (d *ServiceEntryStore) resolveDNSEntries() {
 	for _, config := range d.store.ServiceEntries() {
 		serviceEntry := config.Spec.(*networking.ServiceEntry)
-		services = append(services, convertServices(serviceEntry)...)
+		if len(serviceEntry.Endpoints) > 0 || !isDNSResolution(serviceEntry.Resolution) {
+			continue
+		}
+		key := config.Key()
+		resolved := resolveInstances(serviceEntry)
+		tagInstances(resolved, config.Namespace, convertExportTo(serviceEntry.ExportTo))
+
+		d.storeMutex.Lock()
+		old := d.instancesByKey[key]
+		d.removeInstances(old)
+		d.addInstances(resolved)
+		d.instancesByKey[key] = resolved
+		d.lastChange = time.Now()
+		d.storeMutex.Unlock()
+
+		for _, handler := range d.instanceHandlers {
+			for _, instance := range changedInstances(old, resolved, model.EventUpdate) {
+				go handler(instance, model.EventUpdate)
+			}
+			for _, instance := range removedInstances(old, resolved, model.EventUpdate) {
+				go handler(instance, model.EventDelete)
+			}
+		}
+	}
+}
+
+// Services lists the declared services visible to namespace: entries sourced
+// from namespace itself whose ExportTo is unset, "*", or includes "." or
+// namespace, plus entries sourced from any other namespace whose
+// ExportTo is "*" (or unset, which defaults to "*") or names namespace. An
+// empty namespace returns every known service unfiltered, for callers (e.g.
+// debug/introspection) not evaluating visibility for a proxy.
+func (d *ServiceEntryStore) Services(namespace string) ([]*model.Service, error) {
+	d.update()
+	d.storeMutex.RLock()
+	defer d.storeMutex.RUnlock()
+
+	keys := d.configKeysForNamespace(namespace)
+	services := make([]*model.Service, 0, len(keys))
+	for _, key := range keys {
+		serviceEntry, found := d.specsByKey[key]
+		if !found {
+			continue
+		}
+		sourceNamespace := d.namespaceByKey[key]
+		exportTo := convertExportTo(serviceEntry.ExportTo)
+		for _, service := range convertServices(serviceEntry) {
+			if namespace == "" || visibleToNamespace(sourceNamespace, exportTo, namespace) {
+				services = append(services, service)
+			}
+		}
 	}
 
 	return services, nil
 }
 
-// GetService retrieves a service by host name if it exists
-func (d *ServiceEntryStore) GetService(hostname model.Hostname) (*model.Service, error) {
-	for _, service := range d.getServices() {
+// configKeysForNamespace returns every registered key that could be visible
+// to namespace: the configsByNamespace index's keys for namespace itself,
+// plus the exportIndex keys for "*" and for namespace by name, which cover
+// ServiceEntries sourced from other namespaces. The result can include keys
+// that Services' own visibleToNamespace check then filters back out (e.g. an
+// entry sourced from namespace whose ExportTo names only other namespaces,
+// which configsByNamespace still lists). It returns every registered key if
+// namespace is empty. Callers must hold storeMutex for reading (or writing).
+func (d *ServiceEntryStore) configKeysForNamespace(namespace string) []string {
+	if namespace == "" {
+		keys := make([]string, 0, len(d.specsByKey))
+		for key := range d.specsByKey {
+			keys = append(keys, key)
+		}
+		return keys
+	}
+
+	seen := make(map[string]bool)
+	var keys []string
+	collect := func(candidates []string) {
+		for _, key := range candidates {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	collect(d.configsByNamespace[namespace])
+	collect(d.exportIndex[string(model.VisibilityPublic)])
+	collect(d.exportIndex[namespace])
+	return keys
+}
+
+// GetService retrieves a service by host name if it is visible to namespace.
+func (d *ServiceEntryStore) GetService(hostname model.Hostname, namespace string) (*model.Service, error) {
+	services, err := d.Services(namespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range services {
 		if service.Hostname == hostname {
 			return service, nil
 		}
@@ -149,15 +1092,6 @@ func (d *ServiceEntryStore) GetServiceAttributes(hostname model.Hostname) (*mode
 	return nil, fmt.Errorf("service not found")
 }
 
-func (d *ServiceEntryStore) getServices() []*model.Service {
-	services := make([]*model.Service, 0)
-	for _, config := range d.store.ServiceEntries() {
-		serviceEntry := config.Spec.(*networking.ServiceEntry)
-		services = append(services, convertServices(serviceEntry)...)
-	}
-	return services
-}
-
 // ManagementPorts retries set of health check ports by instance IP.
 // This does not apply to Service Entry registry, as Service entries do not
 // manage the service instances.
@@ -196,9 +1130,10 @@ func (d *ServiceEntryStore) Instances(hostname model.Hostname, ports []string,
 }
 
 // InstancesByPort retrieves instances for a service on the given ports with labels that
-// match any of the supplied labels. All instances match an empty tag list.
+// match any of the supplied labels, that are visible to namespace. All instances
+// match an empty tag list; an empty namespace disables visibility filtering.
 func (d *ServiceEntryStore) InstancesByPort(hostname model.Hostname, port int,
-	labels model.LabelsCollection) ([]*model.ServiceInstance, error) {
+	labels model.LabelsCollection, namespace string) ([]*model.ServiceInstance, error) {
 	d.update()
 
 	d.storeMutex.RLock()
@@ -210,7 +1145,8 @@ func (d *ServiceEntryStore) InstancesByPort(hostname model.Hostname, port int,
 		for _, instance := range instances {
 			if instance.Service.Hostname == hostname &&
 				labels.HasSubsetOf(instance.Labels) &&
-				portMatchSingle(instance, port) {
+				portMatchSingle(instance, port) &&
+				instanceVisible(instance, namespace) {
 				out = append(out, instance)
 			}
 		}
@@ -219,39 +1155,52 @@ func (d *ServiceEntryStore) InstancesByPort(hostname model.Hostname, port int,
 	return out, nil
 }
 
-// update will iterate all ServiceEntries, convert to ServiceInstance (expensive),
-// and populate the 'by host' and 'by ip' maps.
+// update performs the one-time initial index build from whatever ServiceEntries
+// already exist in the store. Once built, the index is kept current
+// incrementally by the event handler registered in NewServiceDiscovery, so
+// this never runs again afterwards.
 func (d *ServiceEntryStore) update() {
 	d.storeMutex.RLock()
-	if !d.updateNeeded {
+	needed := d.updateNeeded
+	d.storeMutex.RUnlock()
+	if !needed {
 		return
 	}
-	d.storeMutex.RUnlock()
 
 	d.storeMutex.Lock()
 	defer d.storeMutex.Unlock()
+	if !d.updateNeeded {
+		return
+	}
+	// Every map below is rebuilt from scratch here. Some are populated by
+	// plain key assignment (safe to leave stale entries in until overwritten),
+	// but namespaceByKey/configsByNamespace, selectorsByKey/selectorIndex and
+	// exportToByKey/exportIndex are populated by indexNamespace/indexSelector/
+	// indexExportTo, which *append* to the reverse index; leaving those in
+	// place would make this rebuild's registerConfig calls duplicate every
+	// key the incremental event handler had already indexed.
 	d.instances = map[string][]*model.ServiceInstance{}
 	d.ip2instance = map[string][]*model.ServiceInstance{}
+	d.instancesByKey = map[string][]*model.ServiceInstance{}
+	d.servicesByKey = map[string][]*model.Service{}
+	d.namespaceByKey = map[string]string{}
+	d.configsByNamespace = map[string][]string{}
+	d.selectorsByKey = map[string]map[string]string{}
+	d.selectorIndex = map[string][]string{}
+	d.workloadInstancesByKey = map[string]map[string][]*model.ServiceInstance{}
+	d.specsByKey = map[string]*networking.ServiceEntry{}
+	d.exportToByKey = map[string]map[model.Visibility]bool{}
+	d.exportIndex = map[string][]string{}
 
 	for _, config := range d.store.ServiceEntries() {
 		serviceEntry := config.Spec.(*networking.ServiceEntry)
-		for _, instance := range convertInstances(serviceEntry) {
-			key := instance.Service.Hostname.String()
-			out, found := d.instances[key]
-			if !found {
-				out = []*model.ServiceInstance{}
-			}
-			out = append(out, instance)
-			d.instances[key] = out
-
-			byip, found := d.instances[instance.Endpoint.Address]
-			if !found {
-				byip = []*model.ServiceInstance{}
-			}
-			byip = append(byip, instance)
-			d.ip2instance[instance.Endpoint.Address] = byip
-		}
+		key := config.Key()
+		services, instances := d.registerConfig(key, config, serviceEntry)
+		d.addInstances(instances)
+		d.instancesByKey[key] = instances
+		d.servicesByKey[key] = services
 	}
+	d.updateNeeded = false
 }
 
 // returns true if an instance's port matches with any in the provided list
@@ -264,17 +1213,67 @@ func portMatchSingle(instance *model.ServiceInstance, port int) bool {
 	return port == 0 || port == instance.Endpoint.ServicePort.Port
 }
 
-// GetProxyServiceInstances lists service instances co-located with a given proxy
+// GetProxyServiceInstances lists service instances co-located with a given
+// proxy that are visible to the proxy's namespace. ip2instance holds both
+// statically-declared Endpoints and, for WorkloadSelector ServiceEntries, the
+// instances synthesized for whichever matching workload owns node's IP, so no
+// separate selector lookup is needed here.
 func (d *ServiceEntryStore) GetProxyServiceInstances(node *model.Proxy) ([]*model.ServiceInstance, error) {
 	d.update()
 	d.storeMutex.RLock()
 	defer d.storeMutex.RUnlock()
 
 	instances, found := d.ip2instance[node.IPAddress]
-	if found {
-		return instances, nil
+	if !found {
+		return []*model.ServiceInstance{}, nil
+	}
+
+	out := make([]*model.ServiceInstance, 0, len(instances))
+	for _, instance := range instances {
+		if instanceVisible(instance, node.Metadata.Namespace) {
+			out = append(out, instance)
+		}
+	}
+	return out, nil
+}
+
+// ServiceTarget carries only the Service+Port a proxy exposes, without the
+// endpoint address or labels a full ServiceInstance carries. Callers that
+// build listeners/routes from a proxy's exposed ports - and don't dispatch to
+// a specific endpoint - should use this instead of ServiceInstance to avoid
+// copying an address/labels they have no use for.
+type ServiceTarget struct {
+	Service *model.Service
+	Port    *model.Port
+}
+
+// ServiceInstanceToTarget strips a ServiceInstance down to the ServiceTarget
+// it exposes.
+func ServiceInstanceToTarget(instance *model.ServiceInstance) ServiceTarget {
+	return ServiceTarget{
+		Service: instance.Service,
+		Port:    instance.Endpoint.ServicePort,
+	}
+}
+
+// GetProxyServiceTargets is GetProxyServiceInstances' lighter-weight sibling,
+// for callers that only need which Service+Port a proxy exposes: it builds
+// targets straight off ip2instance under the read lock instead of going
+// through GetProxyServiceInstances, which would allocate and filter a full
+// []*ServiceInstance just to immediately strip it back down.
+func (d *ServiceEntryStore) GetProxyServiceTargets(node *model.Proxy) []ServiceTarget {
+	d.update()
+	d.storeMutex.RLock()
+	defer d.storeMutex.RUnlock()
+
+	instances := d.ip2instance[node.IPAddress]
+	targets := make([]ServiceTarget, 0, len(instances))
+	for _, instance := range instances {
+		if instanceVisible(instance, node.Metadata.Namespace) {
+			targets = append(targets, ServiceInstanceToTarget(instance))
+		}
 	}
-	return []*model.ServiceInstance{}, nil
+	return targets
 }
 
 // GetIstioServiceAccounts implements model.ServiceAccounts operation TODOg